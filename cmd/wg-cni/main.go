@@ -19,11 +19,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/containernetworking/cni/pkg/ipam"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
@@ -34,12 +42,20 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 
+	"github.com/schu/wireguard-cni/pkg/apis/wgcni/v1alpha1"
 	"github.com/schu/wireguard-cni/pkg/k8sutil"
+	"github.com/schu/wireguard-cni/pkg/metrics"
 	wgnetlink "github.com/schu/wireguard-cni/pkg/netlink"
+	"github.com/schu/wireguard-cni/pkg/state"
 	"github.com/schu/wireguard-cni/pkg/util"
 )
 
+// uapiSocketDir is where wireguard-go (and wgctrl, looking for it)
+// expect a userspace device's UAPI control socket.
+const uapiSocketDir = "/var/run/wireguard"
+
 func init() {
 	log.SetPrefix("[wg-cni] ")
 }
@@ -66,6 +82,17 @@ type PluginConf struct {
 	// Add plugin-specifc flags here
 	KubeConfigPath   string `json: "kubeConfigPath"`
 	StaticConfigPath string `json: "staticConfigPath"`
+
+	// MetricsAddr, if set, is the unix socket of a running wgcni-metricsd
+	// that per-invocation counters are reported to.
+	MetricsAddr string `json:"metricsAddr,omitempty"`
+
+	// Mode selects how wg links are created: "kernel" requires the
+	// host's in-kernel wireguard module, "userspace" always spawns a
+	// wireguard-go process instead, and "auto" (the default) tries the
+	// kernel module first and falls back to wireguard-go if the host
+	// doesn't support it.
+	Mode string `json:"mode,omitempty"`
 }
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -99,6 +126,14 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 		return nil, fmt.Errorf("neither 'kubeConfigPath' nor 'staticConfigPath' given")
 	}
 
+	switch conf.Mode {
+	case "":
+		conf.Mode = "auto"
+	case "kernel", "userspace", "auto":
+	default:
+		return nil, fmt.Errorf("invalid 'mode' %q, must be one of kernel, userspace, auto", conf.Mode)
+	}
+
 	return &conf, nil
 }
 
@@ -113,7 +148,10 @@ type kubernetesArgs struct {
 type wgCNIConfig struct {
 	Address    string `json:"address"`
 	PrivateKey string `json:"privateKey"`
-	Peers      []struct {
+	// InterfaceName optionally pins the name of the wg link created for
+	// this config; if empty, one is generated as "wg"+RandString(6).
+	InterfaceName string `json:"interfaceName,omitempty"`
+	Peers         []struct {
 		Endpoint            string   `json:"endpoint"`
 		PublicKey           string   `json:"publicKey"`
 		PresharedKey        string   `json:"presharedKey,omitempty"`
@@ -122,59 +160,207 @@ type wgCNIConfig struct {
 	} `json:"peers"`
 }
 
-// cmdAdd is called for ADD requests
-func cmdAdd(args *skel.CmdArgs) error {
-	conf, err := parseConfig(args.StdinData)
+// wgCNIAttachment pairs a resolved wgCNIConfig with the name of the
+// configuration source (Secret or WireguardPeering) it came from, so
+// cmdDel and cmdCheck can match it back up with its recorded state.
+type wgCNIAttachment struct {
+	Source string
+	Config wgCNIConfig
+}
+
+// errPodNotConfigured is returned by resolveWGAttachments when the pod
+// is not annotated to be configured with wg-cni, which is not an error:
+// ADD should just pass the result through, and CHECK has nothing to
+// verify.
+var errPodNotConfigured = errors.New("pod is not annotated for wg-cni")
+
+// resolveWGAttachments resolves every wg-cni attachment for the pod args
+// refers to, from the Kubernetes API at conf.KubeConfigPath. It is shared
+// by cmdAdd and cmdCheck so both see the exact same configuration.
+// staticConfigPath is not read: with no kubeConfigPath set, it returns no
+// attachments and a nil error.
+//
+// A pod opts in via one of four annotations, in priority order:
+// `wgcni.schu.io/peerings` and `wgcni.schu.io/peering` name one or more
+// WireguardPeering CRDs in the pod's namespace; `wgcni.schu.io/configsecrets`
+// and `wgcni.schu.io/configsecret` name one or more Secrets holding a raw
+// config.json. Multiple names make the pod a multi-attachment pod, with
+// one wg link created per name.
+func resolveWGAttachments(conf *PluginConf, args *skel.CmdArgs) ([]wgCNIAttachment, error) {
+	if conf.KubeConfigPath == "" {
+		return nil, nil
+	}
+
+	clientset, err := k8sutil.NewClientset(conf.KubeConfigPath)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("could not get k8s clientset: %v", err)
 	}
 
-	if conf.PrevResult == nil {
-		return fmt.Errorf("must be called as chained plugin")
+	var k8sArgs kubernetesArgs
+	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+		return nil, fmt.Errorf("could not load CNI args %q: %v", args.Args, err)
 	}
 
-	var wgConfig wgCNIConfig
-	if conf.KubeConfigPath != "" {
-		clientset, err := k8sutil.NewClientset(conf.KubeConfigPath)
-		if err != nil {
-			return fmt.Errorf("could not get k8s clientset: %v", err)
-		}
+	podNamespace := string(k8sArgs.K8S_POD_NAMESPACE)
+	podName := string(k8sArgs.K8S_POD_NAME)
 
-		var k8sArgs kubernetesArgs
-		if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
-			return fmt.Errorf("could not load CNI args %q: %v", args.Args, err)
-		}
+	podSpec, err := clientset.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get pod spec: %v", err)
+	}
+
+	annotations := podSpec.ObjectMeta.Annotations
+	if annotations == nil {
+		return nil, errPodNotConfigured
+	}
+
+	if names := splitAnnotationList(annotations["wgcni.schu.io/peerings"]); len(names) > 0 {
+		return attachmentsFromPeerings(clientset, conf.KubeConfigPath, podNamespace, names)
+	}
+	if name := annotations["wgcni.schu.io/peering"]; name != "" {
+		return attachmentsFromPeerings(clientset, conf.KubeConfigPath, podNamespace, []string{name})
+	}
+	if names := splitAnnotationList(annotations["wgcni.schu.io/configsecrets"]); len(names) > 0 {
+		return attachmentsFromSecrets(clientset, podNamespace, names)
+	}
+	if name := annotations["wgcni.schu.io/configsecret"]; name != "" {
+		return attachmentsFromSecrets(clientset, podNamespace, []string{name})
+	}
+
+	return nil, errPodNotConfigured
+}
 
-		podNamespace := string(k8sArgs.K8S_POD_NAMESPACE)
-		podName := string(k8sArgs.K8S_POD_NAME)
+// splitAnnotationList splits a comma-separated annotation value into its
+// trimmed, non-empty elements.
+func splitAnnotationList(v string) []string {
+	if v == "" {
+		return nil
+	}
+
+	var names []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			names = append(names, s)
+		}
+	}
+	return names
+}
 
-		podSpec, err := clientset.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
+// attachmentsFromSecrets resolves an attachment for each Secret name,
+// reading its config.json the same way the single-attachment code path
+// always has.
+func attachmentsFromSecrets(clientset kubernetes.Interface, namespace string, names []string) ([]wgCNIAttachment, error) {
+	var attachments []wgCNIAttachment
+	for _, name := range names {
+		wgConfigJSON, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
 		if err != nil {
-			return fmt.Errorf("could not get pod spec: %v", err)
+			return nil, fmt.Errorf("could not get secret '%q' with wg-cni config: %v", name, err)
 		}
 
-		if podSpec.ObjectMeta.Annotations == nil ||
-			podSpec.ObjectMeta.Annotations["wgcni.schu.io/configsecret"] == "" {
-			// This pod is not annoted to be configured
-			// with wg-cni - nothing to do
-			return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+		var wgConfig wgCNIConfig
+		if err := json.Unmarshal(wgConfigJSON.Data["config.json"], &wgConfig); err != nil {
+			return nil, fmt.Errorf("could not unmarshal wg-cni config from secret %q: %v", name, err)
 		}
 
-		configSecretName := podSpec.ObjectMeta.Annotations["wgcni.schu.io/configsecret"]
+		attachments = append(attachments, wgCNIAttachment{Source: name, Config: wgConfig})
+	}
+	return attachments, nil
+}
 
-		wgConfigJSON, err := clientset.CoreV1().Secrets(podNamespace).Get(configSecretName, metav1.GetOptions{})
+// attachmentsFromPeerings resolves an attachment for each WireguardPeering name.
+func attachmentsFromPeerings(clientset kubernetes.Interface, kubeConfigPath, namespace string, names []string) ([]wgCNIAttachment, error) {
+	var attachments []wgCNIAttachment
+	for _, name := range names {
+		wgConfig, err := wgConfigFromPeering(clientset, kubeConfigPath, namespace, name)
 		if err != nil {
-			return fmt.Errorf("could not get secret '%q' with wg-cni config: %v", configSecretName, err)
+			return nil, err
 		}
 
-		if err := json.Unmarshal(wgConfigJSON.Data["config.json"], &wgConfig); err != nil {
-			return fmt.Errorf("could not unmarshal wg-cni config: %v", err)
+		attachments = append(attachments, wgCNIAttachment{Source: name, Config: wgConfig})
+	}
+	return attachments, nil
+}
+
+// wgConfigFromPeering resolves a wgCNIConfig from the WireguardPeering
+// named peeringName in namespace, dereferencing its private and
+// preshared key Secret references via clientset.
+func wgConfigFromPeering(clientset kubernetes.Interface, kubeConfigPath, namespace, peeringName string) (wgCNIConfig, error) {
+	var wgConfig wgCNIConfig
+
+	restConfig, err := k8sutil.NewRestConfig(kubeConfigPath)
+	if err != nil {
+		return wgConfig, fmt.Errorf("could not build rest config: %v", err)
+	}
+
+	wgcniClient, err := v1alpha1.NewForConfig(restConfig)
+	if err != nil {
+		return wgConfig, fmt.Errorf("could not build wgcni client: %v", err)
+	}
+
+	peering, err := wgcniClient.WireguardPeerings(namespace).Get(peeringName, metav1.GetOptions{})
+	if err != nil {
+		return wgConfig, fmt.Errorf("could not get WireguardPeering %q: %v", peeringName, err)
+	}
+
+	wgConfig.Address = peering.Spec.Address
+	wgConfig.InterfaceName = peering.Spec.InterfaceName
+
+	privateKey, err := secretRefValue(clientset, namespace, peering.Spec.PrivateKeySecretRef)
+	if err != nil {
+		return wgConfig, fmt.Errorf("could not resolve private key: %v", err)
+	}
+	wgConfig.PrivateKey = privateKey
+
+	for _, p := range peering.Spec.Peers {
+		var presharedKey string
+		if p.PresharedKeySecretRef != nil {
+			presharedKey, err = secretRefValue(clientset, namespace, *p.PresharedKeySecretRef)
+			if err != nil {
+				return wgConfig, fmt.Errorf("could not resolve preshared key for peer %q: %v", p.PublicKey, err)
+			}
 		}
+
+		wgConfig.Peers = append(wgConfig.Peers, struct {
+			Endpoint            string   `json:"endpoint"`
+			PublicKey           string   `json:"publicKey"`
+			PresharedKey        string   `json:"presharedKey,omitempty"`
+			PersistentKeepalive string   `json:"persistentKeepalive"`
+			AllowedIPs          []string `json:"allowedIPs"`
+		}{
+			Endpoint:            p.Endpoint,
+			PublicKey:           p.PublicKey,
+			PresharedKey:        presharedKey,
+			PersistentKeepalive: p.PersistentKeepalive,
+			AllowedIPs:          p.AllowedIPs,
+		})
 	}
 
+	return wgConfig, nil
+}
+
+// secretRefValue looks up a single key within a Secret in namespace.
+func secretRefValue(clientset kubernetes.Interface, namespace string, ref v1alpha1.SecretKeySelector) (string, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get secret %q: %v", ref.Name, err)
+	}
+
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %q has no key %q", ref.Name, ref.Key)
+	}
+
+	return string(value), nil
+}
+
+// parseWGConfig parses the key material and peer set of a wgCNIConfig
+// into the types wgctrl expects. It is shared by cmdAdd, which uses it
+// to configure the device, and cmdCheck, which uses it to compute the
+// expected state to compare the device against.
+func parseWGConfig(wgConfig wgCNIConfig) (wgtypes.Key, []wgtypes.PeerConfig, error) {
 	privateKey, err := wgtypes.ParseKey(wgConfig.PrivateKey)
 	if err != nil {
-		return fmt.Errorf("could not parse private key: %v", err)
+		return wgtypes.Key{}, nil, fmt.Errorf("could not parse private key: %v", err)
 	}
 
 	var peers []wgtypes.PeerConfig
@@ -183,32 +369,32 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 		peer.PublicKey, err = wgtypes.ParseKey(peerConf.PublicKey)
 		if err != nil {
-			return fmt.Errorf("could not parse public key: %v", err)
+			return wgtypes.Key{}, nil, fmt.Errorf("could not parse public key: %v", err)
 		}
 
 		if peerConf.PresharedKey != "" {
-			PresharedKey, err := wgtypes.ParseKey(peerConf.PresharedKey)
+			presharedKey, err := wgtypes.ParseKey(peerConf.PresharedKey)
 			if err != nil {
-				return fmt.Errorf("could not parse preshared key: %v", err)
+				return wgtypes.Key{}, nil, fmt.Errorf("could not parse preshared key: %v", err)
 			}
-			peer.PresharedKey = &PresharedKey
+			peer.PresharedKey = &presharedKey
 		}
 
 		keepaliveInterval, err := time.ParseDuration(peerConf.PersistentKeepalive)
 		if err != nil {
-			return fmt.Errorf("could not parse keepalive duration string %q: %v", peerConf.PersistentKeepalive, err)
+			return wgtypes.Key{}, nil, fmt.Errorf("could not parse keepalive duration string %q: %v", peerConf.PersistentKeepalive, err)
 		}
 		peer.PersistentKeepaliveInterval = &keepaliveInterval
 
 		peer.Endpoint, err = net.ResolveUDPAddr("udp", peerConf.Endpoint)
 		if err != nil {
-			return fmt.Errorf("could not parse endpoint %q: %v", peerConf.Endpoint, err)
+			return wgtypes.Key{}, nil, fmt.Errorf("could not parse endpoint %q: %v", peerConf.Endpoint, err)
 		}
 
 		for _, allowedIP := range peerConf.AllowedIPs {
 			_, ipnet, err := net.ParseCIDR(allowedIP)
 			if err != nil {
-				return fmt.Errorf("could not parse CIDR %q: %v", allowedIP, err)
+				return wgtypes.Key{}, nil, fmt.Errorf("could not parse CIDR %q: %v", allowedIP, err)
 			}
 
 			peer.AllowedIPs = append(peer.AllowedIPs, *ipnet)
@@ -217,109 +403,663 @@ func cmdAdd(args *skel.CmdArgs) error {
 		peers = append(peers, peer)
 	}
 
+	return privateKey, peers, nil
+}
+
+// createWGAttachment creates and configures a single wg link for
+// wgConfig inside the container netns, named linkName. If ipamResult is
+// non-nil, its first IP is used as the interface address instead of
+// wgConfig.Address. mode selects the link backend ("kernel", "userspace"
+// or "auto", see PluginConf.Mode); it returns the backend actually used,
+// the resolved CIDR address (for state.Interface.Address, so CHECK can
+// verify it later without needing to know about IPAM) and, for
+// "userspace", the PID of the wireguard-go process backing it along
+// with that process's start time (for state.Interface.PIDStartTime, so
+// cmdDel can tell the PID apart from an unrelated process that reused it
+// by the time DEL runs).
+//
+// On any failure it tears back down whatever of the link it already
+// created itself - in the host net ns, already moved into the container
+// net ns, or a spawned wireguard-go process - since a failed attachment
+// is never added to cmdAdd's own list of interfaces to roll back, and
+// no state is ever saved for cmdDel to find it by either.
+func createWGAttachment(netnsHandle netns.NsHandle, netnsNetlinkHandle *netlink.Handle, wgClient *wgctrl.Client, linkName string, wgConfig wgCNIConfig, ipamResult *current.Result, mode string) (usedMode string, pid int, pidStartTime uint64, address string, err error) {
+	privateKey, peers, err := parseWGConfig(wgConfig)
+	if err != nil {
+		return "", 0, 0, "", err
+	}
 	wgctrlConfig := wgtypes.Config{
 		PrivateKey: &privateKey,
 		Peers:      peers,
 	}
 
-	netnsHandle, err := netns.GetFromPath(args.Netns)
+	usedMode = mode
+
+	// kernelLinkCreated and movedToContainerNS track how far a kernel
+	// link got before a failure, so the cleanup below can tear it down
+	// through whichever netlink handle it currently lives under.
+	// spawnedPID is the wireguard-go process started for a userspace
+	// link; it is kept apart from the pid result, which the error
+	// returns below reset to 0.
+	var kernelLinkCreated, movedToContainerNS bool
+	var spawnedPID int
+	defer func() {
+		if err == nil {
+			return
+		}
+		switch {
+		case kernelLinkCreated && movedToContainerNS:
+			if link, lerr := netnsNetlinkHandle.LinkByName(linkName); lerr == nil {
+				netnsNetlinkHandle.LinkDel(link)
+			}
+		case kernelLinkCreated:
+			linkAttrs := netlink.NewLinkAttrs()
+			linkAttrs.Name = linkName
+			netlink.LinkDel(&wgnetlink.Wireguard{LinkAttrs: linkAttrs})
+		case spawnedPID != 0:
+			syscall.Kill(spawnedPID, syscall.SIGTERM)
+		}
+	}()
+
+	if usedMode == "kernel" || usedMode == "auto" {
+		linkAttrs := netlink.NewLinkAttrs()
+		linkAttrs.Name = linkName
+		wgLink := &wgnetlink.Wireguard{LinkAttrs: linkAttrs}
+
+		switch err := netlink.LinkAdd(wgLink); {
+		case err == nil:
+			usedMode = "kernel"
+			kernelLinkCreated = true
+
+			if err := wgClient.ConfigureDevice(linkName, wgctrlConfig); err != nil {
+				return "", 0, 0, "", fmt.Errorf("could not configure wireguard link: %v", err)
+			}
+			if err := netlink.LinkSetNsFd(wgLink, (int)(netnsHandle)); err != nil {
+				return "", 0, 0, "", fmt.Errorf("could not move network interface into container's net namespace: %v", err)
+			}
+			movedToContainerNS = true
+		case mode == "kernel" || !isUnsupportedLinkErr(err):
+			return "", 0, 0, "", fmt.Errorf("could not create wg network interface: %v", err)
+		default:
+			// mode == "auto" and the host kernel has no
+			// wireguard module: fall through to userspace.
+			usedMode = "userspace"
+		}
+	}
+
+	if usedMode == "userspace" {
+		pid, pidStartTime, err = startUserspaceWireguard(netnsHandle, linkName)
+		if err != nil {
+			return "", 0, 0, "", fmt.Errorf("could not start wireguard-go: %v", err)
+		}
+		spawnedPID = pid
+
+		if werr := waitForUAPISocket(linkName, 2*time.Second); werr != nil {
+			err = werr
+			return
+		}
+		if cerr := wgClient.ConfigureDevice(linkName, wgctrlConfig); cerr != nil {
+			err = fmt.Errorf("could not configure wireguard link: %v", cerr)
+			return
+		}
+	}
+
+	containerLink, err := netnsNetlinkHandle.LinkByName(linkName)
 	if err != nil {
-		return fmt.Errorf("could not get container net ns handle: %v", err)
+		return "", 0, 0, "", fmt.Errorf("could not find %q in container net ns: %v", linkName, err)
+	}
+
+	var sourceIP net.IP
+	var sourceIPNet *net.IPNet
+	if ipamResult != nil {
+		sourceIP = ipamResult.IPs[0].Address.IP
+		sourceIPNet = &ipamResult.IPs[0].Address
+	} else {
+		sourceIP, sourceIPNet, err = net.ParseCIDR(wgConfig.Address)
+		if err != nil {
+			return "", 0, 0, "", fmt.Errorf("could not parse cidr %q: %v", wgConfig.Address, err)
+		}
+	}
+
+	resolvedAddr := &net.IPNet{IP: sourceIP, Mask: sourceIPNet.Mask}
+	addr := &netlink.Addr{IPNet: resolvedAddr}
+
+	if err := netnsNetlinkHandle.AddrAdd(containerLink, addr); err != nil {
+		return "", 0, 0, "", fmt.Errorf("could not add address: %v", err)
+	}
+
+	if err := netnsNetlinkHandle.LinkSetUp(containerLink); err != nil {
+		return "", 0, 0, "", fmt.Errorf("could not set link up: %v", err)
+	}
+
+	for _, peer := range peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			// For the source IP CIDR there is a route
+			// already from `ip addr add ...` above.
+			if allowedIP.Contains(sourceIP) {
+				continue
+			}
+
+			route := &netlink.Route{
+				LinkIndex: containerLink.Attrs().Index,
+				Dst:       &allowedIP,
+				Scope:     unix.RT_SCOPE_LINK,
+			}
+			if err := netnsNetlinkHandle.RouteAdd(route); err != nil {
+				return "", 0, 0, "", fmt.Errorf("could not add route for %v: %v", route, err)
+			}
+		}
 	}
 
-	linkName := "wg" + util.RandString(6)
+	return usedMode, pid, pidStartTime, resolvedAddr.String(), nil
+}
+
+// isUnsupportedLinkErr reports whether err is the netlink.LinkAdd
+// failure a host without the in-kernel wireguard module returns.
+func isUnsupportedLinkErr(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPROTONOSUPPORT)
+}
+
+// startUserspaceWireguard spawns a detached wireguard-go process that
+// creates and owns a TUN device named linkName inside the container
+// netns. It outlives this plugin invocation, so the returned PID must be
+// recorded and later signalled by cmdDel to tear the device back down.
+func startUserspaceWireguard(netnsHandle netns.NsHandle, linkName string) (int, uint64, error) {
+	origNS, err := netns.Get()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get current net ns: %v", err)
+	}
+	defer origNS.Close()
 
-	linkAttrs := netlink.NewLinkAttrs()
-	linkAttrs.Name = linkName
+	// Locking the OS thread and switching its netns before forking
+	// wireguard-go means the child inherits the container's netns,
+	// exactly as if it had been started inside it.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer netns.Set(origNS)
 
-	wgLink := &wgnetlink.Wireguard{
-		LinkAttrs: linkAttrs,
+	if err := netns.Set(netnsHandle); err != nil {
+		return 0, 0, fmt.Errorf("could not enter container net ns: %v", err)
+	}
+
+	cmd := exec.Command("wireguard-go", "-f", linkName)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, 0, fmt.Errorf("could not start wireguard-go: %v", err)
+	}
+
+	pid := cmd.Process.Pid
+	startTime, err := processStartTime(pid)
+	if err != nil {
+		cmd.Process.Kill()
+		return 0, 0, fmt.Errorf("could not read wireguard-go process start time: %v", err)
 	}
-	if err := netlink.LinkAdd(wgLink); err != nil {
-		return fmt.Errorf("could not create wg network interface: %v", err)
+	if err := cmd.Process.Release(); err != nil {
+		return 0, 0, fmt.Errorf("could not release wireguard-go process: %v", err)
 	}
 
-	sourceIP, sourceIPNet, err := net.ParseCIDR(wgConfig.Address)
+	return pid, startTime, nil
+}
+
+// processStartTime returns pid's start time, as the 22nd (1-indexed)
+// whitespace-separated field of /proc/<pid>/stat - the kernel's own
+// clock-tick count since boot for when it started pid. Unlike the PID
+// itself, the kernel never reuses this value for a different process,
+// which is what lets verifyWireguardGoProcess tell the process recorded
+// in state.Interface apart from an unrelated process the PID may have
+// been recycled for by the time cmdDel runs.
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// comm (the 2nd field) is parenthesized and may itself contain
+	// spaces or parens, so skip past its closing paren before splitting
+	// the remaining, well-behaved fields on whitespace.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	fields := strings.Fields(string(data)[i+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+
+	// fields[19] is starttime: field 22 overall, minus the 2 leading
+	// fields (pid, comm) already consumed above.
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// verifyWireguardGoProcess reports whether pid is still the same
+// wireguard-go process that was recorded with startTime, rather than an
+// unrelated process that has since reused the PID. A wireguard-go
+// process backing a long-lived pod can easily outlive the PID space
+// wrapping around back to it, so cmdDel must check this before
+// signalling pid.
+func verifyWireguardGoProcess(pid int, startTime uint64) bool {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
 	if err != nil {
-		return fmt.Errorf("could not parse cidr %q: %v", wgConfig.Address, err)
+		return false
+	}
+	if strings.TrimSpace(string(comm)) != "wireguard-go" {
+		return false
+	}
+
+	actual, err := processStartTime(pid)
+	if err != nil {
+		return false
+	}
+	return actual == startTime
+}
+
+// waitForUAPISocket polls for linkName's UAPI control socket to appear,
+// so wgClient.ConfigureDevice has something to dial into once
+// startUserspaceWireguard returns.
+func waitForUAPISocket(linkName string, timeout time.Duration) error {
+	sockPath := uapiSocketDir + "/" + linkName + ".sock"
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(sockPath); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for wireguard-go uapi socket %q", sockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// teardownWGInterface best-effort tears down iface: it sends SIGTERM to
+// the owning wireguard-go process for a userspace interface, or deletes
+// the kernel link otherwise. It is shared by cmdDel and cmdAdd's
+// rollback path.
+func teardownWGInterface(netnsNetlinkHandle *netlink.Handle, iface state.Interface) error {
+	if iface.Mode == "userspace" {
+		if iface.PID == 0 {
+			return nil
+		}
+		if !verifyWireguardGoProcess(iface.PID, iface.PIDStartTime) {
+			// Either already gone, or the PID has since been reused
+			// by an unrelated process - either way, there is no
+			// wireguard-go process left for us to stop.
+			return nil
+		}
+		if err := syscall.Kill(iface.PID, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("could not stop wireguard-go pid %d: %v", iface.PID, err)
+		}
+		return nil
+	}
+
+	link, err := netnsNetlinkHandle.LinkByName(iface.LinkName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			// Already torn down.
+			return nil
+		}
+		return fmt.Errorf("could not find wg link %q: %v", iface.LinkName, err)
 	}
 
-	addr := &netlink.Addr{
-		IPNet: &net.IPNet{
-			IP:   sourceIP,
-			Mask: sourceIPNet.Mask,
-		},
+	// Any routes the ADD path installed are scoped to this
+	// link and are removed by the kernel along with it.
+	if err := netnsNetlinkHandle.LinkDel(link); err != nil {
+		return fmt.Errorf("could not delete wg link %q: %v", iface.LinkName, err)
 	}
 
+	return nil
+}
+
+// cmdAdd is called for ADD requests
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	start := time.Now()
+
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	defer func() { reportInvocation(conf.MetricsAddr, "add", err, start) }()
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	attachments, err := resolveWGAttachments(conf, args)
+	if err != nil {
+		if err == errPodNotConfigured {
+			// This pod is not annotated to be configured with
+			// wg-cni - nothing to do.
+			return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+		}
+		return err
+	}
+
+	if conf.IPAM.Type != "" && len(attachments) > 1 {
+		return fmt.Errorf("ipam delegation is only supported for a single wg-cni attachment, got %d", len(attachments))
+	}
+
+	// success is flipped to true once everything below has succeeded;
+	// until then, any delegated IPAM allocation and any wg links
+	// already created for this invocation must be released again on
+	// the way out.
+	var success bool
+
+	var ipamResult *current.Result
+	if conf.IPAM.Type != "" {
+		r, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+		if err != nil {
+			return fmt.Errorf("could not delegate IPAM add to %q: %v", conf.IPAM.Type, err)
+		}
+		defer func() {
+			if !success {
+				ipam.ExecDel(conf.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return fmt.Errorf("could not convert IPAM result: %v", err)
+		}
+		if len(ipamResult.IPs) == 0 {
+			return fmt.Errorf("IPAM plugin %q returned no IP addresses", conf.IPAM.Type)
+		}
+	}
+
+	netnsHandle, err := netns.GetFromPath(args.Netns)
+	if err != nil {
+		return fmt.Errorf("could not get container net ns handle: %v", err)
+	}
+	defer netnsHandle.Close()
+
+	netnsNetlinkHandle, err := netlink.NewHandleAt(netnsHandle)
+	if err != nil {
+		return fmt.Errorf("could not get container net ns netlink handle: %v", err)
+	}
+	defer netnsNetlinkHandle.Delete()
+
 	wgClient, err := wgctrl.New()
 	if err != nil {
 		return fmt.Errorf("could not get wgctrl client: %v", err)
 	}
 	defer wgClient.Close()
 
-	if err := wgClient.ConfigureDevice(linkName, wgctrlConfig); err != nil {
-		return fmt.Errorf("could not configure wireguard link: %v", err)
+	var ifaces []state.Interface
+	defer func() {
+		if !success {
+			for _, iface := range ifaces {
+				teardownWGInterface(netnsNetlinkHandle, iface)
+			}
+		}
+	}()
+
+	usedNames := map[string]bool{}
+	for _, att := range attachments {
+		linkName := att.Config.InterfaceName
+		for linkName == "" || usedNames[linkName] {
+			linkName = "wg" + util.RandString(6)
+		}
+		usedNames[linkName] = true
+
+		usedMode, pid, pidStartTime, address, err := createWGAttachment(netnsHandle, netnsNetlinkHandle, wgClient, linkName, att.Config, ipamResult, conf.Mode)
+		if err != nil {
+			return fmt.Errorf("attachment %q: %v", att.Source, err)
+		}
+
+		ifaces = append(ifaces, state.Interface{Source: att.Source, LinkName: linkName, Mode: usedMode, PID: pid, PIDStartTime: pidStartTime, Address: address})
+	}
+
+	if err := state.Save(args.ContainerID, &state.State{Interfaces: ifaces, Netns: args.Netns}); err != nil {
+		return fmt.Errorf("could not save plugin state: %v", err)
 	}
 
-	if err := netlink.LinkSetNsFd(wgLink, (int)(netnsHandle)); err != nil {
-		return fmt.Errorf("could not move network interface into container's net namespace: %v", err)
+	if ipamResult != nil {
+		conf.PrevResult.IPs = append(conf.PrevResult.IPs, ipamResult.IPs...)
 	}
 
+	success = true
+
+	// Pass through the result for the next plugin
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+// cmdDel is called for DELETE requests
+func cmdDel(args *skel.CmdArgs) (err error) {
+	start := time.Now()
+
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	defer func() { reportInvocation(conf.MetricsAddr, "del", err, start) }()
+
+	st, err := state.Load(args.ContainerID)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		// Nothing was ever added for this container, or DEL was
+		// already called for it. DEL must be idempotent, so this
+		// is success, not an error.
+		return nil
+	}
+
+	if conf.IPAM.Type != "" {
+		if err := ipam.ExecDel(conf.IPAM.Type, args.StdinData); err != nil {
+			return fmt.Errorf("could not delegate IPAM del to %q: %v", conf.IPAM.Type, err)
+		}
+	}
+
+	netnsHandle, err := netns.GetFromPath(args.Netns)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The netns is already gone, so every kernel wg link
+			// went with it. A userspace wireguard-go process is
+			// independent of the netns though, so it is still
+			// left running and must be stopped explicitly.
+			for _, iface := range st.Interfaces {
+				if iface.Mode == "userspace" && iface.PID != 0 && verifyWireguardGoProcess(iface.PID, iface.PIDStartTime) {
+					syscall.Kill(iface.PID, syscall.SIGTERM)
+				}
+			}
+			return state.Remove(args.ContainerID)
+		}
+		return fmt.Errorf("could not get container net ns handle: %v", err)
+	}
+	defer netnsHandle.Close()
+
 	netnsNetlinkHandle, err := netlink.NewHandleAt(netnsHandle)
 	if err != nil {
 		return fmt.Errorf("could not get container net ns netlink handle: %v", err)
 	}
+	defer netnsNetlinkHandle.Delete()
 
-	if err := netnsNetlinkHandle.AddrAdd(wgLink, addr); err != nil {
-		return fmt.Errorf("could not add address: %v", err)
+	for _, iface := range st.Interfaces {
+		if err := teardownWGInterface(netnsNetlinkHandle, iface); err != nil {
+			return err
+		}
 	}
 
-	if err := netnsNetlinkHandle.LinkSetUp(wgLink); err != nil {
-		return fmt.Errorf("could not set link up: %v", err)
+	return state.Remove(args.ContainerID)
+}
+
+// checkWGAttachment verifies that linkName still matches wgConfig and
+// address: device type, address, private key, peer set and allowed-IPs.
+// address is the CIDR ADD actually assigned (see state.Interface.Address)
+// rather than wgConfig.Address, since that field is empty whenever the
+// address came from a delegated IPAM plugin instead. mode is the backend
+// linkName was created with (see state.Interface.Mode); a userspace
+// attachment is a plain TUN device, not a kernel "wireguard" link, so the
+// device type check only applies to kernel mode.
+func checkWGAttachment(netnsNetlinkHandle *netlink.Handle, wgClient *wgctrl.Client, linkName string, wgConfig wgCNIConfig, address string, mode string) error {
+	link, err := netnsNetlinkHandle.LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("wg link %q not found in container net ns: %v", linkName, err)
+	}
+	if mode != "userspace" && link.Type() != "wireguard" {
+		return fmt.Errorf("link %q is not a wireguard device (type %q)", linkName, link.Type())
 	}
 
-	for _, peer := range peers {
-		for _, allowedIP := range peer.AllowedIPs {
-			// For the source IP CIDR there is a route
-			// already from `ip addr add ...` above.
-			if allowedIP.Contains(sourceIP) {
-				continue
+	wantAddr, wantAddrNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return fmt.Errorf("could not parse cidr %q: %v", address, err)
+	}
+
+	addrs, err := netnsNetlinkHandle.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("could not list addresses on %q: %v", linkName, err)
+	}
+	var haveAddr bool
+	for _, addr := range addrs {
+		if addr.IP.Equal(wantAddr) && addr.Mask.String() == wantAddrNet.Mask.String() {
+			haveAddr = true
+			break
+		}
+	}
+	if !haveAddr {
+		return fmt.Errorf("wg link %q does not have the expected address %s", linkName, address)
+	}
+
+	device, err := wgClient.Device(linkName)
+	if err != nil {
+		return fmt.Errorf("could not get wg device %q: %v", linkName, err)
+	}
+
+	wantPrivateKey, wantPeers, err := parseWGConfig(wgConfig)
+	if err != nil {
+		return err
+	}
+	if device.PrivateKey != wantPrivateKey {
+		return fmt.Errorf("wg device %q has an unexpected private key", linkName)
+	}
+
+	if len(device.Peers) != len(wantPeers) {
+		return fmt.Errorf("wg device %q has %d peers, expected %d", linkName, len(device.Peers), len(wantPeers))
+	}
+
+	for _, wantPeer := range wantPeers {
+		var peer *wgtypes.Peer
+		for i := range device.Peers {
+			if device.Peers[i].PublicKey == wantPeer.PublicKey {
+				peer = &device.Peers[i]
+				break
 			}
+		}
+		if peer == nil {
+			return fmt.Errorf("wg device %q is missing expected peer %s", linkName, wantPeer.PublicKey)
+		}
 
-			route := &netlink.Route{
-				LinkIndex: wgLink.Attrs().Index,
-				Dst:       &allowedIP,
-				Scope:     unix.RT_SCOPE_LINK,
+		for _, wantAllowedIP := range wantPeer.AllowedIPs {
+			var haveAllowedIP bool
+			for _, gotNet := range peer.AllowedIPs {
+				if gotNet.String() == wantAllowedIP.String() {
+					haveAllowedIP = true
+					break
+				}
 			}
-			if err := netnsNetlinkHandle.RouteAdd(route); err != nil {
-				return fmt.Errorf("could not add route for %v: %v", route, err)
+			if !haveAllowedIP {
+				return fmt.Errorf("peer %s on %q is missing allowed IP %s", wantPeer.PublicKey, linkName, wantAllowedIP.String())
 			}
 		}
 	}
 
-	// Pass through the result for the next plugin
-	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	return nil
 }
 
-// cmdDel is called for DELETE requests
-func cmdDel(args *skel.CmdArgs) error {
+// cmdCheck is called for CHECK requests, introduced in CNI spec 0.4.0.
+// It verifies that every wg link ADD created still matches its expected
+// configuration and returns an error describing the first drift found.
+func cmdCheck(args *skel.CmdArgs) (err error) {
+	start := time.Now()
+
 	conf, err := parseConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
-	_ = conf
+	defer func() { reportInvocation(conf.MetricsAddr, "check", err, start) }()
 
-	// Do your delete here
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	attachments, err := resolveWGAttachments(conf, args)
+	if err != nil {
+		if err == errPodNotConfigured {
+			// Nothing was configured for this pod, so there is
+			// nothing to check.
+			return nil
+		}
+		return err
+	}
+
+	st, err := state.Load(args.ContainerID)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return fmt.Errorf("no wg-cni state recorded for container %q", args.ContainerID)
+	}
+
+	ifacesBySource := make(map[string]state.Interface, len(st.Interfaces))
+	for _, iface := range st.Interfaces {
+		ifacesBySource[iface.Source] = iface
+	}
+
+	netnsHandle, err := netns.GetFromPath(args.Netns)
+	if err != nil {
+		return fmt.Errorf("could not get container net ns handle: %v", err)
+	}
+	defer netnsHandle.Close()
+
+	netnsNetlinkHandle, err := netlink.NewHandleAt(netnsHandle)
+	if err != nil {
+		return fmt.Errorf("could not get container net ns netlink handle: %v", err)
+	}
+	defer netnsNetlinkHandle.Delete()
+
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("could not get wgctrl client: %v", err)
+	}
+	defer wgClient.Close()
+
+	for _, att := range attachments {
+		iface, ok := ifacesBySource[att.Source]
+		if !ok {
+			return fmt.Errorf("no wg-cni state recorded for attachment %q", att.Source)
+		}
+
+		address := iface.Address
+		if address == "" {
+			// State file written before ADD recorded the resolved
+			// address (or a non-IPAM config where it never
+			// changes): fall back to the static config value.
+			address = att.Config.Address
+		}
+
+		if err := checkWGAttachment(netnsNetlinkHandle, wgClient, iface.LinkName, att.Config, address, iface.Mode); err != nil {
+			return fmt.Errorf("attachment %q: %v", att.Source, err)
+		}
+	}
 
 	return nil
 }
 
-func main() {
-	// TODO: implement plugin version
-	skel.PluginMain(cmdAdd, cmdGet, cmdDel, version.All, "TODO")
+// reportInvocation is a thin wrapper around metrics.ReportInvocation
+// that derives the result label from err and is always safe to call,
+// even with an empty socketPath.
+func reportInvocation(socketPath, op string, err error, start time.Time) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	metrics.ReportInvocation(socketPath, metrics.InvocationEvent{
+		Op:       op,
+		Result:   result,
+		Duration: time.Since(start),
+	})
 }
 
-func cmdGet(args *skel.CmdArgs) error {
-	// TODO: implement
-	return fmt.Errorf("not implemented")
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.PluginSupports("0.3.0", "0.3.1", "0.4.0", "1.0.0"), "wg-cni v0.4.0")
 }
@@ -0,0 +1,104 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+// Copyright 2017 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSplitAnnotationList(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{name: "empty", in: "", want: nil},
+		{name: "single", in: "my-secret", want: []string{"my-secret"}},
+		{name: "multiple", in: "a,b,c", want: []string{"a", "b", "c"}},
+		{name: "surrounding whitespace", in: " a , b ,c ", want: []string{"a", "b", "c"}},
+		{name: "empty entries dropped", in: "a,,b,", want: []string{"a", "b"}},
+		{name: "only empty entries", in: " , ,", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitAnnotationList(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitAnnotationList(%q) = %#v, want %#v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUnsupportedLinkErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "EOPNOTSUPP", err: unix.EOPNOTSUPP, want: true},
+		{name: "ENOTSUP", err: unix.ENOTSUP, want: true},
+		{name: "EPROTONOSUPPORT", err: unix.EPROTONOSUPPORT, want: true},
+		{name: "unrelated errno", err: unix.EEXIST, want: false},
+		{name: "nil", err: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUnsupportedLinkErr(tt.err); got != tt.want {
+				t.Errorf("isUnsupportedLinkErr(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessStartTime(t *testing.T) {
+	got, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatalf("processStartTime(self): %v", err)
+	}
+	if got == 0 {
+		t.Error("processStartTime(self) = 0, want a nonzero clock-tick count")
+	}
+}
+
+func TestVerifyWireguardGoProcess(t *testing.T) {
+	selfStart, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatalf("processStartTime(self): %v", err)
+	}
+
+	// The test binary is never actually named wireguard-go, so even
+	// with its own correct start time it must never verify - this is
+	// the comm check that keeps cmdDel from signalling a PID recycled
+	// for some other program.
+	if verifyWireguardGoProcess(os.Getpid(), selfStart) {
+		t.Error("verifyWireguardGoProcess(self, correct start time) = true, want false (comm is not wireguard-go)")
+	}
+
+	if verifyWireguardGoProcess(os.Getpid(), selfStart+1) {
+		t.Error("verifyWireguardGoProcess(self, wrong start time) = true, want false")
+	}
+
+	const implausiblePID = 1<<31 - 1
+	if verifyWireguardGoProcess(implausiblePID, 0) {
+		t.Error("verifyWireguardGoProcess(nonexistent pid) = true, want false")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// wgcni-metricsd is a long-running sidecar that serves the Prometheus
+// metrics the short-lived wg-cni plugin process cannot serve itself: it
+// receives per-invocation counters from wg-cni over a unix socket and
+// periodically polls wgctrl for live tunnel and peer state.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/schu/wireguard-cni/pkg/metrics"
+	"github.com/schu/wireguard-cni/pkg/state"
+)
+
+func main() {
+	listenAddr := flag.String("listen", ":9273", "address to serve /metrics on")
+	socketPath := flag.String("socket", "/var/run/wgcni-metricsd.sock", "unix socket wg-cni reports invocations to")
+	pollInterval := flag.Duration("poll-interval", 15*time.Second, "how often to poll wgctrl for tunnel/peer state")
+	flag.Parse()
+
+	log.SetPrefix("[wgcni-metricsd] ")
+
+	reg := prometheus.NewRegistry()
+	m := metrics.New(reg)
+
+	if err := os.Remove(*socketPath); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("could not remove stale socket %q: %v", *socketPath, err)
+	}
+
+	listener, err := net.Listen("unix", *socketPath)
+	if err != nil {
+		log.Fatalf("could not listen on %q: %v", *socketPath, err)
+	}
+	go serveInvocations(listener, m)
+
+	go pollDevices(*pollInterval, m)
+
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	log.Printf("serving /metrics on %s", *listenAddr)
+	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+}
+
+// serveInvocations accepts connections on listener and records each
+// decoded metrics.InvocationEvent as a counter/histogram observation.
+func serveInvocations(listener net.Listener, m *metrics.Metrics) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("could not accept invocation report: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var ev metrics.InvocationEvent
+			if err := json.NewDecoder(conn).Decode(&ev); err != nil {
+				log.Printf("could not decode invocation report: %v", err)
+				return
+			}
+
+			m.CmdTotal.WithLabelValues(ev.Op, ev.Result).Inc()
+			m.CmdDuration.WithLabelValues(ev.Op, ev.Result).Observe(ev.Duration.Seconds())
+		}()
+	}
+}
+
+// pollDevices periodically refreshes the tunnel/peer gauges from the
+// live wg devices of every container wg-cni has state for. Kernel-mode
+// interfaces only exist inside their container's net namespace, so each
+// container tracked in wg-cni's state is polled from within its own
+// namespace rather than the sidecar's host namespace.
+func pollDevices(interval time.Duration, m *metrics.Metrics) {
+	for range time.Tick(interval) {
+		states, err := state.LoadAll()
+		if err != nil {
+			log.Printf("could not list wg-cni state: %v", err)
+			continue
+		}
+
+		var devices []*wgtypes.Device
+		for _, st := range states {
+			if st.Netns == "" {
+				continue
+			}
+
+			netnsDevices, err := devicesInNetns(st.Netns)
+			if err != nil {
+				log.Printf("could not poll wg devices in %q: %v", st.Netns, err)
+				continue
+			}
+			devices = append(devices, netnsDevices...)
+		}
+
+		m.UpdateFromDevices(devices)
+	}
+}
+
+// devicesInNetns lists the wg devices visible inside the net namespace
+// at netnsPath, entering it on the calling goroutine's OS thread for the
+// duration of the wgctrl call and restoring the original namespace
+// before returning.
+func devicesInNetns(netnsPath string) ([]*wgtypes.Device, error) {
+	targetNS, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer targetNS.Close()
+
+	origNS, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer origNS.Close()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer netns.Set(origNS)
+
+	if err := netns.Set(targetNS); err != nil {
+		return nil, err
+	}
+
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer wgClient.Close()
+
+	return wgClient.Devices()
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	if err := AddToScheme(scheme); err != nil {
+		panic(err)
+	}
+}
+
+// Client is a minimal typed client for the wgcni.schu.io/v1alpha1 API
+// group. It is hand-written rather than client-gen'd, since the plugin
+// only ever needs to Get WireguardPeerings by name.
+type Client struct {
+	restClient rest.Interface
+}
+
+// NewForConfig returns a Client for the wgcni.schu.io/v1alpha1 API
+// group, using config as the base for all requests.
+func NewForConfig(config *rest.Config) (*Client, error) {
+	configCopy := *config
+	configCopy.GroupVersion = &GroupVersion
+	configCopy.APIPath = "/apis"
+	configCopy.NegotiatedSerializer = serializer.NewCodecFactory(scheme).WithoutConversion()
+
+	restClient, err := rest.RESTClientFor(&configCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{restClient: restClient}, nil
+}
+
+// WireguardPeeringInterface operates on WireguardPeering resources in a
+// single namespace.
+type WireguardPeeringInterface interface {
+	Get(name string, opts metav1.GetOptions) (*WireguardPeering, error)
+}
+
+// WireguardPeerings returns a WireguardPeeringInterface scoped to namespace.
+func (c *Client) WireguardPeerings(namespace string) WireguardPeeringInterface {
+	return &wireguardPeeringClient{restClient: c.restClient, ns: namespace}
+}
+
+type wireguardPeeringClient struct {
+	restClient rest.Interface
+	ns         string
+}
+
+func (c *wireguardPeeringClient) Get(name string, opts metav1.GetOptions) (*WireguardPeering, error) {
+	result := &WireguardPeering{}
+	err := c.restClient.Get().
+		Namespace(c.ns).
+		Resource("wireguardpeerings").
+		Name(name).
+		VersionedParams(&opts, runtime.NewParameterCodec(scheme)).
+		Do().
+		Into(result)
+	return result, err
+}
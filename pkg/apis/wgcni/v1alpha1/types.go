@@ -0,0 +1,85 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package v1alpha1 contains the wgcni.schu.io/v1alpha1 API types: the
+// WireguardPeering CRD that lets cluster admins describe a WireGuard
+// tunnel as a first-class Kubernetes resource instead of a hand-managed
+// Secret.
+//
+// +groupName=wgcni.schu.io
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// WireguardPeering is a namespaced CRD describing a WireGuard tunnel: its
+// address, private key and peer set. A pod opts into it with the
+// `wgcni.schu.io/peering` annotation, naming a WireguardPeering in its
+// own namespace.
+type WireguardPeering struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec WireguardPeeringSpec `json:"spec"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// WireguardPeeringList is a list of WireguardPeering resources.
+type WireguardPeeringList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []WireguardPeering `json:"items"`
+}
+
+// WireguardPeeringSpec is the desired state of a WireguardPeering.
+type WireguardPeeringSpec struct {
+	// Address is the CIDR assigned to the wg interface inside the pod.
+	Address string `json:"address"`
+
+	// PrivateKeySecretRef points at the Secret key holding the
+	// interface's base64-encoded WireGuard private key.
+	PrivateKeySecretRef SecretKeySelector `json:"privateKeySecretRef"`
+
+	// InterfaceName optionally pins the name of the wg link created for
+	// this peering; if empty, one is generated.
+	InterfaceName string `json:"interfaceName,omitempty"`
+
+	// Peers are the remote WireGuard peers to configure.
+	Peers []WireguardPeer `json:"peers"`
+}
+
+// WireguardPeer is a single remote peer of a WireguardPeering.
+type WireguardPeer struct {
+	Endpoint  string `json:"endpoint,omitempty"`
+	PublicKey string `json:"publicKey"`
+
+	// PresharedKeySecretRef optionally points at the Secret key holding
+	// this peer's base64-encoded preshared key.
+	PresharedKeySecretRef *SecretKeySelector `json:"presharedKeySecretRef,omitempty"`
+
+	PersistentKeepalive string   `json:"persistentKeepalive,omitempty"`
+	AllowedIPs          []string `json:"allowedIPs"`
+}
+
+// SecretKeySelector references a single key within a Secret in the same
+// namespace as the WireguardPeering.
+type SecretKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
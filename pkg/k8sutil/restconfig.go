@@ -0,0 +1,39 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sutil
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewRestConfig builds a *rest.Config for kubeConfigPath, the same
+// config NewClientset uses internally. It is exposed separately for
+// callers that need to build their own typed clients, such as the
+// wgcni CRD client.
+func NewRestConfig(kubeConfigPath string) (*rest.Config, error) {
+	if kubeConfigPath == "" {
+		return rest.InClusterConfig()
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", kubeConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not build rest config from %q: %v", kubeConfigPath, err)
+	}
+
+	return config, nil
+}
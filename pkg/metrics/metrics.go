@@ -0,0 +1,100 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics defines the Prometheus collectors wg-cni and its
+// wgcni-metricsd sidecar report on, and the small protocol the
+// short-lived plugin process uses to hand invocation results to the
+// long-running sidecar.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Metrics holds every collector wg-cni reports on. It is built with a
+// prometheus.Registerer rather than registering against the global
+// default registry, so callers - including tests - can supply their own.
+type Metrics struct {
+	CmdTotal          *prometheus.CounterVec
+	CmdDuration       *prometheus.HistogramVec
+	ActiveTunnels     prometheus.Gauge
+	PeerLastHandshake *prometheus.GaugeVec
+	PeerRxBytes       *prometheus.GaugeVec
+	PeerTxBytes       *prometheus.GaugeVec
+}
+
+// New creates wg-cni's collectors and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		CmdTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wgcni_cmd_total",
+			Help: "Number of wg-cni plugin invocations by operation and result.",
+		}, []string{"op", "result"}),
+		CmdDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "wgcni_cmd_duration_seconds",
+			Help: "Duration of wg-cni plugin invocations in seconds.",
+		}, []string{"op", "result"}),
+		ActiveTunnels: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "wgcni_active_tunnels",
+			Help: "Number of wg-cni managed tunnels currently active on this node.",
+		}),
+		PeerLastHandshake: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "wgcni_peer_last_handshake_seconds",
+			Help: "Unix time of the last handshake with a peer.",
+		}, []string{"device", "peer"}),
+		PeerRxBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "wgcni_peer_rx_bytes",
+			Help: "Bytes received from a peer.",
+		}, []string{"device", "peer"}),
+		PeerTxBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "wgcni_peer_tx_bytes",
+			Help: "Bytes sent to a peer.",
+		}, []string{"device", "peer"}),
+	}
+
+	reg.MustRegister(
+		m.CmdTotal,
+		m.CmdDuration,
+		m.ActiveTunnels,
+		m.PeerLastHandshake,
+		m.PeerRxBytes,
+		m.PeerTxBytes,
+	)
+
+	return m
+}
+
+// UpdateFromDevices sets the tunnel-count and per-peer gauges from the
+// current state of every wg device wgctrl reports on this node. It
+// resets the per-peer gauges first, since pod churn means the device/peer
+// set passed in one call is rarely the same as the last: without the
+// reset, a torn-down tunnel's last-known values and label combination
+// would otherwise live in the registry forever.
+func (m *Metrics) UpdateFromDevices(devices []*wgtypes.Device) {
+	m.PeerLastHandshake.Reset()
+	m.PeerRxBytes.Reset()
+	m.PeerTxBytes.Reset()
+
+	m.ActiveTunnels.Set(float64(len(devices)))
+
+	for _, d := range devices {
+		for _, p := range d.Peers {
+			peer := p.PublicKey.String()
+			m.PeerLastHandshake.WithLabelValues(d.Name, peer).Set(float64(p.LastHandshakeTime.Unix()))
+			m.PeerRxBytes.WithLabelValues(d.Name, peer).Set(float64(p.ReceiveBytes))
+			m.PeerTxBytes.WithLabelValues(d.Name, peer).Set(float64(p.TransmitBytes))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestNewRegistersCollectors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+
+	m.CmdTotal.WithLabelValues("add", "success").Inc()
+
+	if got := testutil.ToFloat64(m.CmdTotal.WithLabelValues("add", "success")); got != 1 {
+		t.Errorf("wgcni_cmd_total{op=add,result=success} = %v, want 1", got)
+	}
+
+	if mfs, err := reg.Gather(); err != nil {
+		t.Fatalf("could not gather from reg: %v", err)
+	} else if len(mfs) == 0 {
+		t.Fatal("New did not register any collectors with reg")
+	}
+}
+
+func TestUpdateFromDevices(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+
+	peerKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatalf("could not generate peer key: %v", err)
+	}
+
+	devices := []*wgtypes.Device{
+		{
+			Name: "wg0",
+			Peers: []wgtypes.Peer{
+				{
+					PublicKey:         peerKey,
+					LastHandshakeTime: time.Unix(1000, 0),
+					ReceiveBytes:      100,
+					TransmitBytes:     200,
+				},
+			},
+		},
+	}
+
+	m.UpdateFromDevices(devices)
+
+	if got := testutil.ToFloat64(m.ActiveTunnels); got != 1 {
+		t.Errorf("wgcni_active_tunnels = %v, want 1", got)
+	}
+
+	peer := peerKey.String()
+	if got := testutil.ToFloat64(m.PeerLastHandshake.WithLabelValues("wg0", peer)); got != 1000 {
+		t.Errorf("wgcni_peer_last_handshake_seconds = %v, want 1000", got)
+	}
+	if got := testutil.ToFloat64(m.PeerRxBytes.WithLabelValues("wg0", peer)); got != 100 {
+		t.Errorf("wgcni_peer_rx_bytes = %v, want 100", got)
+	}
+	if got := testutil.ToFloat64(m.PeerTxBytes.WithLabelValues("wg0", peer)); got != 200 {
+		t.Errorf("wgcni_peer_tx_bytes = %v, want 200", got)
+	}
+}
+
+func TestUpdateFromDevicesClearsVanishedPeers(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+
+	peerKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatalf("could not generate peer key: %v", err)
+	}
+
+	m.UpdateFromDevices([]*wgtypes.Device{
+		{
+			Name: "wg0",
+			Peers: []wgtypes.Peer{
+				{PublicKey: peerKey, ReceiveBytes: 100},
+			},
+		},
+	})
+
+	// wg0 and its peer are torn down, so the next poll sees no devices
+	// at all - their gauges must not keep reporting stale values.
+	m.UpdateFromDevices(nil)
+
+	if got := testutil.ToFloat64(m.ActiveTunnels); got != 0 {
+		t.Errorf("wgcni_active_tunnels = %v, want 0 after tunnel teardown", got)
+	}
+
+	peer := peerKey.String()
+	if got, err := testutil.GatherAndCount(reg, "wgcni_peer_rx_bytes"); err != nil {
+		t.Fatalf("could not gather wgcni_peer_rx_bytes: %v", err)
+	} else if got != 0 {
+		t.Errorf("wgcni_peer_rx_bytes has %d series for %q, want 0 after teardown", got, peer)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// InvocationEvent is a single plugin invocation report, sent by wg-cni
+// to wgcni-metricsd over a unix socket.
+type InvocationEvent struct {
+	Op       string        `json:"op"`
+	Result   string        `json:"result"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ReportInvocation sends ev to the wgcni-metricsd listening on
+// socketPath. Since a CNI plugin invocation must not fail just because
+// no metrics sidecar is running, this is best-effort: a disabled or
+// unreachable socketPath is silently ignored.
+func ReportInvocation(socketPath string, ev InvocationEvent) {
+	if socketPath == "" {
+		return
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_ = json.NewEncoder(conn).Encode(ev)
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package state persists the wg-cni interfaces created for a container
+// across the ADD/DEL plugin invocations, so that DEL can find and tear
+// down what ADD created without any other record of it.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// defaultStateDir is a var rather than a const so tests can point it at
+// a temporary directory instead of touching the real host path.
+var defaultStateDir = "/var/lib/cni/wireguard"
+
+// Interface records a single wg-cni managed interface. Source is the
+// name of the configuration source (a Secret or WireguardPeering) the
+// interface was created for, used by CHECK to match a live link back up
+// with the attachment it belongs to.
+type Interface struct {
+	Source   string `json:"source,omitempty"`
+	LinkName string `json:"linkName"`
+
+	// Mode is "kernel" or "userspace", recording which backend created
+	// LinkName so DEL knows how to tear it back down. Empty is
+	// equivalent to "kernel", for state files written before userspace
+	// mode existed.
+	Mode string `json:"mode,omitempty"`
+
+	// PID is the process ID of the wireguard-go process backing
+	// LinkName, set only when Mode is "userspace".
+	PID int `json:"pid,omitempty"`
+
+	// PIDStartTime is PID's start time, as reported by the kernel at
+	// the time it was spawned (see processStartTime in cmd/wg-cni).
+	// Unlike PID itself, the kernel never reuses this value, so DEL can
+	// use it to confirm PID still refers to the same wireguard-go
+	// process before signalling it, rather than an unrelated process
+	// that has since reused the PID over the container's lifetime.
+	// Zero for state files written before this check existed.
+	PIDStartTime uint64 `json:"pidStartTime,omitempty"`
+
+	// Address is the CIDR address ADD actually assigned to LinkName,
+	// whether that came from the config's static `address` field or
+	// from a delegated IPAM result. CHECK compares against this instead
+	// of re-deriving or re-resolving the address itself. Empty for
+	// state files written before IPAM delegation existed, in which case
+	// it falls back to the static `address` field.
+	Address string `json:"address,omitempty"`
+}
+
+// State records every wg-cni managed interface for a single container.
+type State struct {
+	Interfaces []Interface `json:"interfaces"`
+
+	// Netns is the container network namespace path ADD was called
+	// with (args.Netns). Kernel-mode interfaces live only inside it,
+	// so wgcni-metricsd needs it to poll their live device/peer state
+	// from the same namespace the pod actually runs in.
+	Netns string `json:"netns,omitempty"`
+}
+
+// Save persists the state for containerID.
+func Save(containerID string, st *State) error {
+	statePath, err := path(containerID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(defaultStateDir, 0700); err != nil {
+		return fmt.Errorf("could not create state dir %q: %v", defaultStateDir, err)
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("could not marshal state: %v", err)
+	}
+
+	if err := os.WriteFile(statePath, data, 0600); err != nil {
+		return fmt.Errorf("could not write state file: %v", err)
+	}
+
+	return nil
+}
+
+// Load reads back the state for containerID. It returns a nil State and
+// a nil error if no state file exists, since DEL must be idempotent and
+// may be called for a container that was never successfully ADDed, or
+// that was already torn down.
+func Load(containerID string) (*State, error) {
+	statePath, err := path(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state file: %v", err)
+	}
+
+	var st State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("could not unmarshal state: %v", err)
+	}
+
+	return &st, nil
+}
+
+// LoadAll reads back the state for every container wg-cni currently has
+// a state file for, so a caller like wgcni-metricsd that does not know
+// the set of container IDs up front can still enumerate them.
+func LoadAll() ([]*State, error) {
+	entries, err := os.ReadDir(defaultStateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state dir %q: %v", defaultStateDir, err)
+	}
+
+	var states []*State
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		st, err := Load(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("could not load state for %q: %v", entry.Name(), err)
+		}
+		if st != nil {
+			states = append(states, st)
+		}
+	}
+
+	return states, nil
+}
+
+// Remove deletes the state file for containerID, if present. It is not
+// an error for the file to already be gone.
+func Remove(containerID string) error {
+	statePath, err := path(containerID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove state file: %v", err)
+	}
+	return nil
+}
+
+// path builds the state file path for containerID, rejecting any value
+// that is not a plain path segment, so a malformed or malicious
+// ContainerID can never point Save/Load/Remove outside defaultStateDir.
+func path(containerID string) (string, error) {
+	if containerID == "" || containerID != filepath.Base(containerID) || containerID == "." || containerID == ".." {
+		return "", fmt.Errorf("invalid container ID %q", containerID)
+	}
+	return filepath.Join(defaultStateDir, containerID), nil
+}
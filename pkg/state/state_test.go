@@ -0,0 +1,135 @@
+// Copyright 2019 Michael Schubert <schu@schu.io>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func withTestStateDir(t *testing.T) {
+	t.Helper()
+	orig := defaultStateDir
+	defaultStateDir = t.TempDir()
+	t.Cleanup(func() { defaultStateDir = orig })
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	withTestStateDir(t)
+
+	want := &State{
+		Interfaces: []Interface{
+			{Source: "my-secret", LinkName: "wg0", Mode: "userspace", PID: 1234, PIDStartTime: 5678, Address: "10.0.0.2/24"},
+		},
+		Netns: "/var/run/netns/test",
+	}
+
+	if err := Save("container-1", want); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	got, err := Load("container-1")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadMissingReturnsNil(t *testing.T) {
+	withTestStateDir(t)
+
+	got, err := Load("no-such-container")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got != nil {
+		t.Errorf("Load = %+v, want nil", got)
+	}
+}
+
+func TestLoadAll(t *testing.T) {
+	withTestStateDir(t)
+
+	st1 := &State{Interfaces: []Interface{{LinkName: "wg0"}}}
+	st2 := &State{Interfaces: []Interface{{LinkName: "wg1"}}}
+	if err := Save("container-1", st1); err != nil {
+		t.Fatalf("Save container-1: %v", err)
+	}
+	if err := Save("container-2", st2); err != nil {
+		t.Fatalf("Save container-2: %v", err)
+	}
+
+	got, err := LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("LoadAll returned %d states, want 2", len(got))
+	}
+}
+
+func TestLoadAllEmptyDir(t *testing.T) {
+	withTestStateDir(t)
+
+	got, err := LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("LoadAll = %+v, want empty", got)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	withTestStateDir(t)
+
+	if err := Save("container-1", &State{}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := Remove("container-1"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	got, err := Load("container-1")
+	if err != nil {
+		t.Fatalf("Load after Remove: %v", err)
+	}
+	if got != nil {
+		t.Errorf("Load after Remove = %+v, want nil", got)
+	}
+
+	// Removing an already-gone state file must stay idempotent.
+	if err := Remove("container-1"); err != nil {
+		t.Errorf("second Remove: %v", err)
+	}
+}
+
+func TestSaveLoadRemoveRejectInvalidContainerID(t *testing.T) {
+	withTestStateDir(t)
+
+	for _, containerID := range []string{"", ".", "..", "../escape", "foo/../../escape", "/absolute"} {
+		if err := Save(containerID, &State{}); err == nil {
+			t.Errorf("Save(%q) = nil error, want error", containerID)
+		}
+		if _, err := Load(containerID); err == nil {
+			t.Errorf("Load(%q) = nil error, want error", containerID)
+		}
+		if err := Remove(containerID); err == nil {
+			t.Errorf("Remove(%q) = nil error, want error", containerID)
+		}
+	}
+}